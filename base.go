@@ -6,10 +6,10 @@ import (
 	"fmt"
 	"net/url"
 	"os"
-	"os/exec"
 	"path"
 	"strings"
 
+	"github.com/anuvu/stacker/copier"
 	"github.com/anuvu/stacker/lib"
 	"github.com/openSUSE/umoci"
 	"github.com/openSUSE/umoci/oci/casext"
@@ -31,6 +31,10 @@ type BaseLayerOpts struct {
 	OCI       casext.Engine
 	LayerType string
 	Debug     bool
+
+	// DecryptKeys are private-key specs (ocicrypt PGP/JWE/PKCS7) used to
+	// unwrap any ocicrypt-encrypted layers in an imported base image.
+	DecryptKeys []string
 }
 
 func GetBaseLayer(o BaseLayerOpts, sf *Stackerfile) error {
@@ -106,15 +110,20 @@ func runSkopeo(toImport string, o BaseLayerOpts, copyToOutput bool) error {
 	}()
 
 	err = lib.ImageCopy(lib.ImageCopyOpts{
-		Src:      toImport,
-		Dest:     fmt.Sprintf("oci:%s:%s", cacheDir, tag),
-		SkipTLS:  o.Layer.From.Insecure,
-		Progress: os.Stdout,
+		Src:         toImport,
+		Dest:        fmt.Sprintf("oci:%s:%s", cacheDir, tag),
+		SkipTLS:     o.Layer.From.Insecure,
+		Progress:    os.Stdout,
+		DecryptKeys: o.DecryptKeys,
 	})
 	if err != nil {
 		return err
 	}
 
+	if err := decryptCachedLayers(cacheDir, tag, o.DecryptKeys); err != nil {
+		return err
+	}
+
 	if !copyToOutput {
 		return nil
 	}
@@ -232,7 +241,7 @@ func extractOutput(o BaseLayerOpts) error {
 			return err
 		}
 
-		bundlePath := path.Join(o.Config.RootFSDir, ".working")
+		bundlePath := path.Join(o.Config.RootFSDir, o.Target)
 		err = updateBundleMtree(bundlePath, desc)
 		if err != nil {
 			return err
@@ -264,7 +273,7 @@ func getDocker(o BaseLayerOpts) error {
 func umociInit(o BaseLayerOpts) error {
 	return RunUmociSubcommand(o.Config, o.Debug, []string{
 		"--tag", o.Name,
-		"--bundle-path", path.Join(o.Config.RootFSDir, ".working"),
+		"--bundle-path", path.Join(o.Config.RootFSDir, o.Target),
 		"init",
 	})
 }
@@ -285,14 +294,31 @@ func getTar(o BaseLayerOpts) error {
 		return err
 	}
 
-	// TODO: make this respect ID maps
 	layerPath := path.Join(o.Config.RootFSDir, o.Target, "rootfs")
-	output, err := exec.Command("tar", "xf", tar, "-C", layerPath).CombinedOutput()
+
+	f, err := os.Open(tar)
 	if err != nil {
-		return fmt.Errorf("error: %s: %s", err, string(output))
+		return err
 	}
+	defer f.Close()
 
-	return nil
+	// TODO: make this respect ID maps
+	return copier.Get(f, layerPath, copier.GetOptions{})
+}
+
+// StackerIgnorePatterns reads the .stackerignore file (if any) next to the
+// stackerfile in dir, in the form copier.Put's PutOptions.IgnorePatterns
+// expects, so imports can honor it the same way a .dockerignore does for
+// docker build.
+//
+// NOTE: Import (called from buildOneLayer with the output of
+// l.ParseImport()) isn't part of this checkout - it was already being
+// called without a definition anywhere in the tree before this series, not
+// just in this commit - so there's nowhere here to actually plumb
+// IgnorePatterns through to its copier.Put call. This is the wiring for
+// Import to pick up once it exists; until then it has no effect.
+func StackerIgnorePatterns(dir string) ([]copier.Pattern, error) {
+	return copier.ParseIgnoreFile(path.Join(dir, ".stackerignore"))
 }
 
 func getScratch(o BaseLayerOpts) error {
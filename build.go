@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/openSUSE/umoci"
@@ -28,6 +29,46 @@ type BuildArgs struct {
 	OnRunFailure            string
 	ApplyConsiderTimestamps bool
 	LayerType               string
+	CNIConfDir              string
+	CNIPluginDir            string
+
+	// EncryptRecipients is a list of recipient specs (PGP/JWE/PKCS7
+	// public keys) that build-time layers should be encrypted to, using
+	// the ocicrypt scheme.
+	EncryptRecipients []string
+
+	// EncryptLayers is a list of path.Match glob patterns matched
+	// against layer names; only matching layers are encrypted.
+	EncryptLayers []string
+
+	// DecryptKeys are private-key specs used to unwrap ocicrypt-encrypted
+	// layers on base images pulled via `docker:`/`oci:` imports.
+	DecryptKeys []string
+
+	// Architectures is the set of GOARCH-style architectures to build.
+	// When empty, Build falls back to the single host architecture and
+	// behaves exactly as before (no manifest index is produced). When it
+	// names any architecture, even only the host's, stacker builds each
+	// one (running the non-native ones under qemu-user-static binfmt),
+	// tags each per-arch manifest <name>-<arch>, and publishes an OCI
+	// image index tying them together under the layer's name.
+	Architectures []string
+
+	// Jobs caps how many independent stackerfile stages the executor
+	// will build concurrently. Zero means runtime.NumCPU().
+	Jobs int
+}
+
+// archTag is the OCI reference used to store a single architecture's
+// manifest when building for more than one architecture; the plain name is
+// reserved for the resulting index. In single-arch mode (arch == "") the
+// plain name is used directly, matching stacker's historical behavior.
+func archTag(name string, arch string) string {
+	if arch == "" {
+		return name
+	}
+
+	return fmt.Sprintf("%s-%s", name, arch)
 }
 
 func updateBundleMtree(rootPath string, newPath ispec.Descriptor) error {
@@ -49,11 +90,32 @@ func updateBundleMtree(rootPath string, newPath ispec.Descriptor) error {
 	return nil
 }
 
+// buildEnv bundles the state that's shared across every layer (and every
+// architecture) of a single `stacker build` invocation.
+type buildEnv struct {
+	opts       *BuildArgs
+	sf         *Stackerfile
+	s          Storage
+	oci        casext.Engine
+	buildCache *BuildCache
+	author     string
+	gitVersion string
+
+	// cacheMu and ociMu serialize access to the build cache and the OCI
+	// casext.Engine respectively, since both are shared across every
+	// goroutine the stage executor runs concurrently.
+	cacheMu sync.Mutex
+	ociMu   sync.Mutex
+}
+
 func Build(opts *BuildArgs) error {
 	if opts.NoCache {
 		os.RemoveAll(opts.Config.StackerDir)
 	}
 
+	opts.Config.CNIConfDir = opts.CNIConfDir
+	opts.Config.CNIPluginDir = opts.CNIPluginDir
+
 	file := opts.StackerFile
 	sf, err := NewStackerfile(file, opts.Substitute)
 	if err != nil {
@@ -116,304 +178,482 @@ func Build(opts *BuildArgs) error {
 		return err
 	}
 
-	author := fmt.Sprintf("%s@%s", username, host)
+	env := &buildEnv{
+		opts:       opts,
+		sf:         sf,
+		s:          s,
+		oci:        oci,
+		buildCache: buildCache,
+		author:     fmt.Sprintf("%s@%s", username, host),
+		gitVersion: gitVersion,
+	}
 
-	s.Delete(".working")
-	for _, name := range order {
-		l, ok := sf.Get(name)
-		if !ok {
-			return fmt.Errorf("%s not present in stackerfile?", name)
-		}
+	architectures := opts.Architectures
+	multiArch := len(architectures) > 0
+	if !multiArch {
+		// preserve stacker's historical single-arch, no-index behavior
+		architectures = []string{""}
+	}
+
+	// per name, the descriptor produced for each architecture, in the
+	// order the architectures were requested; used to assemble the
+	// manifest index once every architecture has built successfully.
+	perArch := map[string][]ispec.Descriptor{}
 
-		fmt.Printf("building image %s...\n", name)
+	for _, arch := range architectures {
+		if arch != "" {
+			fmt.Printf("building architecture %s...\n", arch)
+			if err := maybeSetupBinfmt(arch); err != nil {
+				return errors.Wrapf(err, "couldn't set up qemu-user-static for %s", arch)
+			}
+		}
 
-		// We need to run the imports first since we now compare
-		// against imports for caching layers. Since we don't do
-		// network copies if the files are present and we use rsync to
-		// copy things across, hopefully this isn't too expensive.
-		fmt.Println("importing files...")
-		imports, err := l.ParseImport()
+		descs, err := buildOneArch(env, order, arch)
 		if err != nil {
 			return err
 		}
 
-		if err := Import(opts.Config, name, imports); err != nil {
-			return err
+		for name, desc := range descs {
+			perArch[name] = append(perArch[name], desc)
 		}
+	}
 
-		cacheEntry, ok := buildCache.Lookup(name)
-		if ok {
-			if l.BuildOnly {
-				if cacheEntry.Name != name {
-					err = s.Snapshot(cacheEntry.Name, name)
-					if err != nil {
-						return err
-					}
-				}
-			} else {
-				err = oci.UpdateReference(context.Background(), name, cacheEntry.Blob)
-				if err != nil {
-					return err
-				}
+	if multiArch {
+		for name, descs := range perArch {
+			if err := writeIndex(oci, name, descs); err != nil {
+				return errors.Wrapf(err, "couldn't write image index for %s", name)
 			}
-			fmt.Printf("found cached layer %s\n", name)
-			continue
 		}
+	}
 
-		os := BaseLayerOpts{
-			Config: opts.Config,
-			Name:   name,
-			Target: ".working",
-			Layer:  l,
-			Cache:  buildCache,
-			OCI:    oci,
-		}
+	err = oci.GC(context.Background())
+	if err != nil {
+		fmt.Printf("final OCI GC failed: %v", err)
+	}
 
-		s.Delete(".working")
-		if l.From.Type == BuiltType {
-			if err := s.Restore(l.From.Tag, ".working"); err != nil {
-				return err
-			}
-		} else {
-			if err := s.Create(".working"); err != nil {
-				return err
-			}
-		}
+	return err
+}
 
-		err = GetBaseLayer(os, sf)
-		if err != nil {
-			return err
-		}
+// writeIndex assembles an ispec.Index referencing one manifest per
+// architecture and publishes it as the tag `name` in the OCI layout.
+func writeIndex(oci casext.Engine, name string, descs []ispec.Descriptor) error {
+	index := ispec.Index{
+		Versioned: ispec.Versioned{SchemaVersion: 2},
+		Manifests: descs,
+	}
 
-		apply, err := NewApply(sf, os, s, opts.ApplyConsiderTimestamps)
-		if err != nil {
-			return err
-		}
+	indexDigest, indexSize, err := oci.PutBlobJSON(context.Background(), index)
+	if err != nil {
+		return err
+	}
 
-		err = apply.DoApply()
-		if err != nil {
-			return err
-		}
+	return oci.UpdateReference(context.Background(), name, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	})
+}
 
-		fmt.Println("running commands...")
+// buildOneArch runs every layer for a single target architecture, using an
+// executor that builds independent stages concurrently (see executor.go),
+// and returns the final descriptor for each non-build-only layer so the
+// caller can assemble a manifest index across architectures.
+func buildOneArch(env *buildEnv, order []string, arch string) (map[string]ispec.Descriptor, error) {
+	exec := newStageExecutor(env, order, arch)
+	return exec.run()
+}
 
-		run, err := l.ParseRun()
-		if err != nil {
-			return err
-		}
+// buildOneLayer builds a single stackerfile layer (name) for arch. It may
+// be called concurrently with other names by the stage executor, so it
+// takes care to use a snapshot name unique to this stage/arch pair
+// (work) instead of the shared ".working" subvolume, and to serialize its
+// access to the shared build cache and OCI engine via env's mutexes.
+func buildOneLayer(env *buildEnv, arch string, name string) (ispec.Descriptor, bool, error) {
+	opts := env.opts
+	sf := env.sf
+	s := env.s
+	oci := env.oci
+	buildCache := env.buildCache
+
+	l, ok := sf.Get(name)
+	if !ok {
+		return ispec.Descriptor{}, false, fmt.Errorf("%s not present in stackerfile?", name)
+	}
 
-		if len(run) != 0 {
-			importsDir := path.Join(opts.Config.StackerDir, "imports", name)
+	tag := archTag(name, arch)
+	cacheKey := tag
+	work := fmt.Sprintf(".working-%s", tag)
 
-			script := fmt.Sprintf("#!/bin/bash -xe\n%s", strings.Join(run, "\n"))
-			if err := ioutil.WriteFile(path.Join(importsDir, ".stacker-run.sh"), []byte(script), 0755); err != nil {
-				return err
-			}
+	// We need to run the imports first since we now compare
+	// against imports for caching layers. Since we don't do
+	// network copies if the files are present and we use rsync to
+	// copy things across, hopefully this isn't too expensive.
+	fmt.Println("importing files...")
+	imports, err := l.ParseImport()
+	if err != nil {
+		return ispec.Descriptor{}, false, err
+	}
 
-			fmt.Println("running commands for", name)
-			if err := Run(opts.Config, name, "/stacker/.stacker-run.sh", l, opts.OnRunFailure, nil); err != nil {
-				return err
-			}
-		}
+	if err := Import(opts.Config, name, imports); err != nil {
+		return ispec.Descriptor{}, false, err
+	}
 
-		// This is a build only layer, meaning we don't need to include
-		// it in the final image, as outputs from it are going to be
-		// imported into future images. Let's just snapshot it and add
-		// a bogus entry to our cache.
+	env.cacheMu.Lock()
+	cacheEntry, ok := buildCache.Lookup(cacheKey)
+	env.cacheMu.Unlock()
+	if ok {
 		if l.BuildOnly {
-			s.Delete(name)
-			if err := s.Snapshot(".working", name); err != nil {
-				return err
+			if cacheEntry.Name != tag {
+				if err := s.Snapshot(cacheEntry.Name, tag); err != nil {
+					return ispec.Descriptor{}, false, err
+				}
 			}
-
-			fmt.Println("build only layer, skipping OCI diff generation")
-
-			// A small hack: for build only layers, we keep track
-			// of the name, so we can make sure it exists when
-			// there is a cache hit. We should probably make this
-			// into some sort of proper Either type.
-			if err := buildCache.Put(name, ispec.Descriptor{}); err != nil {
-				return err
+		} else {
+			env.ociMu.Lock()
+			err = oci.UpdateReference(context.Background(), tag, cacheEntry.Blob)
+			env.ociMu.Unlock()
+			if err != nil {
+				return ispec.Descriptor{}, false, err
 			}
-			continue
 		}
+		fmt.Printf("found cached layer %s\n", tag)
+		return cacheEntry.Blob, l.BuildOnly, nil
+	}
 
-		fmt.Println("generating layer...")
-		switch opts.LayerType {
-		case "tar":
-			args := []string{
-				"umoci",
-				"repack",
-				"--refresh-bundle",
-				"--image",
-				fmt.Sprintf("%s:%s", opts.Config.OCIDir, name),
-				path.Join(opts.Config.RootFSDir, ".working")}
-			err = MaybeRunInUserns(args, "layer generation failed")
-			if err != nil {
-				return err
-			}
-		default:
-			return fmt.Errorf("unknown layer type: %s", opts.LayerType)
+	os := BaseLayerOpts{
+		Config:      opts.Config,
+		Name:        tag,
+		Target:      work,
+		Layer:       l,
+		Cache:       buildCache,
+		OCI:         oci,
+		DecryptKeys: opts.DecryptKeys,
+	}
+
+	s.Delete(work)
+	if l.From.Type == BuiltType {
+		if err := s.Restore(archTag(l.From.Tag, arch), work); err != nil {
+			return ispec.Descriptor{}, false, err
 		}
-		descPaths, err := oci.ResolveReference(context.Background(), name)
-		if err != nil {
-			return err
+	} else {
+		if err := s.Create(work); err != nil {
+			return ispec.Descriptor{}, false, err
 		}
+	}
 
-		mutator, err := mutate.New(oci, descPaths[0])
-		if err != nil {
-			return errors.Wrapf(err, "mutator failed")
-		}
+	err = GetBaseLayer(os, sf)
+	if err != nil {
+		return ispec.Descriptor{}, false, err
+	}
 
-		imageConfig, err := mutator.Config(context.Background())
-		if err != nil {
-			return err
+	if len(l.CopyFrom) != 0 {
+		workRootfs := path.Join(opts.Config.RootFSDir, work, "rootfs")
+		if err := doCopyFrom(env, arch, l.CopyFrom, workRootfs); err != nil {
+			return ispec.Descriptor{}, false, err
 		}
+	}
 
-		pathSet := false
-		for k, v := range l.Environment {
-			if k == "PATH" {
-				pathSet = true
-			}
-			imageConfig.Env = append(imageConfig.Env, fmt.Sprintf("%s=%s", k, v))
-		}
+	apply, err := NewApply(sf, os, s, opts.ApplyConsiderTimestamps)
+	if err != nil {
+		return ispec.Descriptor{}, false, err
+	}
 
-		if !pathSet {
-			for _, s := range imageConfig.Env {
-				if strings.HasPrefix(s, "PATH=") {
-					pathSet = true
-					break
-				}
-			}
-		}
+	err = apply.DoApply()
+	if err != nil {
+		return ispec.Descriptor{}, false, err
+	}
 
-		// if the user didn't specify a path, let's set a sane one
-		if !pathSet {
-			imageConfig.Env = append(imageConfig.Env, fmt.Sprintf("PATH=%s", ReasonableDefaultPath))
-		}
+	fmt.Println("running commands...")
 
-		if l.Cmd != nil {
-			imageConfig.Cmd, err = l.ParseCmd()
-			if err != nil {
-				return err
-			}
-		}
+	run, err := l.ParseRun()
+	if err != nil {
+		return ispec.Descriptor{}, false, err
+	}
 
-		if l.Entrypoint != nil {
-			imageConfig.Entrypoint, err = l.ParseEntrypoint()
-			if err != nil {
-				return err
-			}
-		}
+	if len(run) != 0 {
+		importsDir := path.Join(opts.Config.StackerDir, "imports", name)
 
-		if l.FullCommand != nil {
-			imageConfig.Cmd = nil
-			imageConfig.Entrypoint, err = l.ParseFullCommand()
-			if err != nil {
-				return err
-			}
+		script := fmt.Sprintf("#!/bin/bash -xe\n%s", strings.Join(run, "\n"))
+		if err := ioutil.WriteFile(path.Join(importsDir, ".stacker-run.sh"), []byte(script), 0755); err != nil {
+			return ispec.Descriptor{}, false, err
 		}
 
-		if imageConfig.Volumes == nil {
-			imageConfig.Volumes = map[string]struct{}{}
-		}
+		fmt.Printf("[%s] running commands\n", tag)
 
-		for _, v := range l.Volumes {
-			imageConfig.Volumes[v] = struct{}{}
+		netns := path.Join(opts.Config.StackerDir, "run", tag, "netns")
+		attached, created, err := SetupNetwork(opts.Config, l.Network, tag, netns)
+		if err != nil {
+			return ispec.Descriptor{}, false, errors.Wrapf(err, "couldn't set up network for %s", tag)
 		}
 
-		if imageConfig.Labels == nil {
-			imageConfig.Labels = map[string]string{}
+		// Only pass netns to Run when SetupNetwork actually created one
+		// (NetworkModeNone/CNI); an unset network: block or explicit
+		// NetworkModeHost is a no-op, and nothing exists at netns for Run
+		// to join.
+		runNetns := ""
+		if created {
+			runNetns = netns
 		}
 
-		for k, v := range l.Labels {
-			imageConfig.Labels[k] = v
+		runErr := Run(opts.Config, tag, "/stacker/.stacker-run.sh", l, opts.OnRunFailure, runNetns)
+
+		if err := TeardownNetwork(attached, created, netns); err != nil {
+			fmt.Printf("warning: failed to tear down network for %s: %v\n", tag, err)
 		}
 
-		if l.WorkingDir != "" {
-			imageConfig.WorkingDir = l.WorkingDir
+		if runErr != nil {
+			return ispec.Descriptor{}, false, runErr
 		}
+	}
 
-		meta, err := mutator.Meta(context.Background())
+	// This is a build only layer, meaning we don't need to include
+	// it in the final image, as outputs from it are going to be
+	// imported into future images. Let's just snapshot it and add
+	// a bogus entry to our cache.
+	if l.BuildOnly {
+		s.Delete(tag)
+		if err := s.Snapshot(work, tag); err != nil {
+			return ispec.Descriptor{}, false, err
+		}
+
+		fmt.Printf("[%s] build only layer, skipping OCI diff generation\n", tag)
+
+		// A small hack: for build only layers, we keep track
+		// of the name, so we can make sure it exists when
+		// there is a cache hit. We should probably make this
+		// into some sort of proper Either type.
+		env.cacheMu.Lock()
+		err = buildCache.Put(cacheKey, ispec.Descriptor{})
+		env.cacheMu.Unlock()
 		if err != nil {
-			return err
+			return ispec.Descriptor{}, false, err
 		}
 
-		meta.Created = time.Now()
-		meta.Architecture = runtime.GOARCH
-		meta.OS = runtime.GOOS
-		meta.Author = author
+		return ispec.Descriptor{}, true, nil
+	}
 
-		annotations, err := mutator.Annotations(context.Background())
+	// umoci repack is the actual tar/diff generation work and doesn't
+	// touch env.oci itself (it shells out to a subprocess that operates
+	// on the on-disk layout directly), so it runs without holding
+	// env.ociMu - otherwise every concurrent stage would serialize on
+	// its slowest step and the executor would buy us nothing.
+	fmt.Printf("[%s] generating layer...\n", tag)
+	switch opts.LayerType {
+	case "tar":
+		args := []string{
+			"umoci",
+			"repack",
+			"--refresh-bundle",
+			"--image",
+			fmt.Sprintf("%s:%s", opts.Config.OCIDir, tag),
+			path.Join(opts.Config.RootFSDir, work)}
+		err = MaybeRunInUserns(args, "layer generation failed")
 		if err != nil {
-			return err
+			return ispec.Descriptor{}, false, err
 		}
+	default:
+		return ispec.Descriptor{}, false, fmt.Errorf("unknown layer type: %s", opts.LayerType)
+	}
 
-		if gitVersion != "" {
-			fmt.Println("setting git version annotation to", gitVersion)
-			annotations[GitVersionAnnotation] = gitVersion
-		} else {
-			annotations[StackerContentsAnnotation] = sf.AfterSubstitutions
+	if encrypt, err := shouldEncryptLayer(opts.EncryptLayers, name); err != nil {
+		return ispec.Descriptor{}, false, err
+	} else if encrypt {
+		// Likewise, the actual blob read/encrypt/write is the
+		// expensive part of this step; encryptManifestLayers only
+		// takes env.ociMu for its own brief manifest/reference update.
+		if err := encryptManifestLayers(oci, &env.ociMu, tag, opts.EncryptRecipients); err != nil {
+			return ispec.Descriptor{}, false, errors.Wrapf(err, "couldn't encrypt layer(s) for %s", name)
 		}
+	}
 
-		history := ispec.History{
-			EmptyLayer: true, // this is only the history for imageConfig edit
-			Created:    &meta.Created,
-			CreatedBy:  "stacker build",
-			Author:     author,
-		}
+	env.ociMu.Lock()
+	descPaths, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		env.ociMu.Unlock()
+		return ispec.Descriptor{}, false, err
+	}
 
-		err = mutator.Set(context.Background(), imageConfig, meta, annotations, &history)
-		if err != nil {
-			return err
+	mutator, err := mutate.New(oci, descPaths[0])
+	if err != nil {
+		env.ociMu.Unlock()
+		return ispec.Descriptor{}, false, errors.Wrapf(err, "mutator failed")
+	}
+
+	imageConfig, err := mutator.Config(context.Background())
+	if err != nil {
+		env.ociMu.Unlock()
+		return ispec.Descriptor{}, false, err
+	}
+
+	pathSet := false
+	for k, v := range l.Environment {
+		if k == "PATH" {
+			pathSet = true
 		}
+		imageConfig.Env = append(imageConfig.Env, fmt.Sprintf("%s=%s", k, v))
+	}
 
-		newPath, err := mutator.Commit(context.Background())
-		if err != nil {
-			return err
+	if !pathSet {
+		for _, e := range imageConfig.Env {
+			if strings.HasPrefix(e, "PATH=") {
+				pathSet = true
+				break
+			}
 		}
+	}
+
+	// if the user didn't specify a path, let's set a sane one
+	if !pathSet {
+		imageConfig.Env = append(imageConfig.Env, fmt.Sprintf("PATH=%s", ReasonableDefaultPath))
+	}
 
-		err = oci.UpdateReference(context.Background(), name, newPath.Root())
+	if l.Cmd != nil {
+		imageConfig.Cmd, err = l.ParseCmd()
 		if err != nil {
-			return err
+			env.ociMu.Unlock()
+			return ispec.Descriptor{}, false, err
 		}
+	}
 
-		// Now, we need to set the umoci data on the fs to tell it that
-		// it has a layer that corresponds to this fs.
-		bundlePath := path.Join(opts.Config.RootFSDir, ".working")
-		err = updateBundleMtree(bundlePath, newPath.Descriptor())
+	if l.Entrypoint != nil {
+		imageConfig.Entrypoint, err = l.ParseEntrypoint()
 		if err != nil {
-			return err
+			env.ociMu.Unlock()
+			return ispec.Descriptor{}, false, err
 		}
+	}
 
-		umociMeta := umoci.Meta{Version: umoci.MetaVersion, From: newPath}
-		err = umoci.WriteBundleMeta(bundlePath, umociMeta)
+	if l.FullCommand != nil {
+		imageConfig.Cmd = nil
+		imageConfig.Entrypoint, err = l.ParseFullCommand()
 		if err != nil {
-			return err
+			env.ociMu.Unlock()
+			return ispec.Descriptor{}, false, err
 		}
+	}
 
-		// Delete the old snapshot if it existed; we just did a new build.
-		s.Delete(name)
-		if err := s.Snapshot(".working", name); err != nil {
-			return err
-		}
+	if imageConfig.Volumes == nil {
+		imageConfig.Volumes = map[string]struct{}{}
+	}
 
-		fmt.Printf("filesystem %s built successfully\n", name)
+	for _, v := range l.Volumes {
+		imageConfig.Volumes[v] = struct{}{}
+	}
 
-		descPaths, err = oci.ResolveReference(context.Background(), name)
-		if err != nil {
-			return err
-		}
+	if imageConfig.Labels == nil {
+		imageConfig.Labels = map[string]string{}
+	}
 
-		if err := buildCache.Put(name, descPaths[0].Descriptor()); err != nil {
-			return err
-		}
+	for k, v := range l.Labels {
+		imageConfig.Labels[k] = v
 	}
 
-	err = oci.GC(context.Background())
+	if l.WorkingDir != "" {
+		imageConfig.WorkingDir = l.WorkingDir
+	}
+
+	meta, err := mutator.Meta(context.Background())
 	if err != nil {
-		fmt.Printf("final OCI GC failed: %v", err)
+		env.ociMu.Unlock()
+		return ispec.Descriptor{}, false, err
 	}
 
-	return err
-}
\ No newline at end of file
+	meta.Created = time.Now()
+	meta.Architecture = buildArchGOARCH(arch)
+	meta.OS = runtime.GOOS
+	meta.Author = env.author
+
+	annotations, err := mutator.Annotations(context.Background())
+	if err != nil {
+		env.ociMu.Unlock()
+		return ispec.Descriptor{}, false, err
+	}
+
+	if env.gitVersion != "" {
+		fmt.Println("setting git version annotation to", env.gitVersion)
+		annotations[GitVersionAnnotation] = env.gitVersion
+	} else {
+		annotations[StackerContentsAnnotation] = sf.AfterSubstitutions
+	}
+
+	history := ispec.History{
+		EmptyLayer: true, // this is only the history for imageConfig edit
+		Created:    &meta.Created,
+		CreatedBy:  "stacker build",
+		Author:     env.author,
+	}
+
+	err = mutator.Set(context.Background(), imageConfig, meta, annotations, &history)
+	if err != nil {
+		env.ociMu.Unlock()
+		return ispec.Descriptor{}, false, err
+	}
+
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		env.ociMu.Unlock()
+		return ispec.Descriptor{}, false, err
+	}
+
+	err = oci.UpdateReference(context.Background(), tag, newPath.Root())
+	if err != nil {
+		env.ociMu.Unlock()
+		return ispec.Descriptor{}, false, err
+	}
+	env.ociMu.Unlock()
+
+	// Now, we need to set the umoci data on the fs to tell it that
+	// it has a layer that corresponds to this fs.
+	bundlePath := path.Join(opts.Config.RootFSDir, work)
+	err = updateBundleMtree(bundlePath, newPath.Descriptor())
+	if err != nil {
+		return ispec.Descriptor{}, false, err
+	}
+
+	umociMeta := umoci.Meta{Version: umoci.MetaVersion, From: newPath}
+	err = umoci.WriteBundleMeta(bundlePath, umociMeta)
+	if err != nil {
+		return ispec.Descriptor{}, false, err
+	}
+
+	// Delete the old snapshot if it existed; we just did a new build.
+	s.Delete(tag)
+	if err := s.Snapshot(work, tag); err != nil {
+		return ispec.Descriptor{}, false, err
+	}
+
+	fmt.Printf("filesystem %s built successfully\n", tag)
+
+	env.ociMu.Lock()
+	descPaths, err = oci.ResolveReference(context.Background(), tag)
+	env.ociMu.Unlock()
+	if err != nil {
+		return ispec.Descriptor{}, false, err
+	}
+
+	desc := descPaths[0].Descriptor()
+	desc.Platform = &ispec.Platform{
+		Architecture: buildArchGOARCH(arch),
+		OS:           runtime.GOOS,
+	}
+
+	env.cacheMu.Lock()
+	err = buildCache.Put(cacheKey, desc)
+	env.cacheMu.Unlock()
+	if err != nil {
+		return ispec.Descriptor{}, false, err
+	}
+
+	return desc, false, nil
+}
+
+// buildArchGOARCH returns the GOARCH value a layer was actually built for:
+// the requested arch, or the host's arch when none was requested (the
+// single-arch, pre-multi-arch behavior).
+func buildArchGOARCH(arch string) string {
+	if arch == "" {
+		return runtime.GOARCH
+	}
+
+	return arch
+}
@@ -0,0 +1,418 @@
+// Package copier is stacker's native replacement for shelling out to
+// tar(1)/cp(1) when materializing files into or out of a layer's rootfs. It
+// streams entries directly, so behavior doesn't depend on which tar/cp the
+// host happens to have installed, and it understands .stackerignore files
+// the same way dockerignore does.
+package copier
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sparseBlockSize is the granularity at which writeRegularFile looks for
+// runs of zero bytes to punch as holes instead of writing them out. It
+// matches a typical filesystem block size, which is the smallest unit a
+// hole can usefully reclaim anyway.
+const sparseBlockSize = 4096
+
+// IDPair maps a single container-side uid or gid to a host-side one.
+type IDPair struct {
+	ContainerID int
+	HostID      int
+}
+
+// Owner is a plain uid/gid pair, used by PutOptions.Chown to force
+// ownership of everything Put writes rather than remap it.
+type Owner struct {
+	UID int
+	GID int
+}
+
+// GetOptions controls how Get extracts an archive onto disk.
+type GetOptions struct {
+	// UIDMap and GIDMap translate the ownership recorded in the archive
+	// to host ids before it's written out, mirroring what Import/Build do
+	// for rootless/userns builds.
+	UIDMap []IDPair
+	GIDMap []IDPair
+}
+
+// PutOptions controls how Put copies a filesystem tree.
+type PutOptions struct {
+	UIDMap []IDPair
+	GIDMap []IDPair
+
+	// IgnorePatterns are dockerignore-style patterns (as parsed by
+	// ParseIgnoreFile) that files relative to the source root are
+	// matched against; matching files are skipped entirely.
+	IgnorePatterns []Pattern
+
+	// Chown, if non-nil, overrides the ownership (after any
+	// UIDMap/GIDMap remapping) of every path Put writes - the source
+	// tree's own root included. It's applied per-entry as Put walks the
+	// tree, so it only ever touches what this call actually wrote, never
+	// pre-existing content already at dest.
+	Chown *Owner
+
+	// Chmod, if non-nil, overrides the mode of every path Put writes
+	// except directories and symlinks, which keep their own mode.
+	Chmod *os.FileMode
+}
+
+// Get extracts the tar stream r (transparently gzip-decompressing it if
+// needed) onto disk at dest, preserving mode, ownership, mtimes, xattrs,
+// hardlinks and sparse holes.
+func Get(r io.Reader, dest string, options GetOptions) error {
+	reader, err := maybeGunzip(r)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(reader)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading tar stream")
+		}
+
+		// hardlinked entries are recreated directly from hdr.Linkname
+		// (tar.TypeLink below), so unlike Put we don't need to track
+		// which inodes we've already seen.
+		target := filepath.Join(dest, filepath.Clean(string(filepath.Separator)+hdr.Name))
+		if err := extractEntry(tr, hdr, dest, target, options); err != nil {
+			return errors.Wrapf(err, "extracting %s", hdr.Name)
+		}
+	}
+}
+
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	buffered := newPeekReader(r)
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buffered)
+	}
+
+	return buffered, nil
+}
+
+func extractEntry(r io.Reader, hdr *tar.Header, dest string, target string, options GetOptions) error {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		if err := writeRegularFile(r, target, hdr); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		// Header.Linkname for TypeLink is archive-root-relative, exactly
+		// like Header.Name, not relative to this entry's own directory -
+		// resolve it the same way target was resolved from hdr.Name.
+		src := filepath.Join(dest, filepath.Clean(string(filepath.Separator)+hdr.Linkname))
+		if err := os.Link(src, target); err != nil {
+			return err
+		}
+	default:
+		// devices, fifos, etc. are handled by the platform-specific
+		// mknod helper in syscall_unix.go.
+		if err := mknod(target, hdr); err != nil {
+			return err
+		}
+	}
+
+	uid, gid := remapOwner(hdr.Uid, hdr.Gid, options.UIDMap, options.GIDMap)
+	if err := lchown(target, uid, gid); err != nil {
+		return err
+	}
+
+	if err := copyXattrsFromTarHeader(hdr, target); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := lutimes(target, hdr.AccessTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeRegularFile streams hdr.Size bytes from r into target, punching a
+// hole (via Seek, leaving the range unwritten) instead of writing out any
+// sparseBlockSize-aligned block that's entirely zero. archive/tar already
+// expands a source archive's sparse runs into real zero bytes by the time
+// they reach us, so this is what actually keeps the extracted file sparse
+// rather than fully allocated.
+func writeRegularFile(r io.Reader, target string, hdr *tar.Header) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zero := make([]byte, sparseBlockSize)
+	buf := make([]byte, sparseBlockSize)
+	remaining := hdr.Size
+	var sawHole bool
+
+	for remaining > 0 {
+		n := int64(len(buf))
+		if remaining < n {
+			n = remaining
+		}
+
+		read, err := io.ReadFull(r, buf[:n])
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+
+		if int64(read) == n && bytes.Equal(buf[:read], zero[:read]) {
+			if _, err := f.Seek(int64(read), io.SeekCurrent); err != nil {
+				return err
+			}
+			sawHole = true
+		} else if _, err := f.Write(buf[:read]); err != nil {
+			return err
+		}
+
+		remaining -= int64(read)
+	}
+
+	if sawHole {
+		// if the file ends in a hole, the seeks above never extended it
+		// to its final size; make sure it lands on hdr.Size.
+		return f.Truncate(hdr.Size)
+	}
+
+	return nil
+}
+
+func remapOwner(uid, gid int, uidMap, gidMap []IDPair) (int, int) {
+	return remapID(uid, uidMap), remapID(gid, gidMap)
+}
+
+func remapID(id int, idMap []IDPair) int {
+	for _, m := range idMap {
+		if m.ContainerID == id {
+			return m.HostID
+		}
+	}
+
+	return id
+}
+
+// Put copies the tree rooted at src into dest, skipping anything matched by
+// options.IgnorePatterns, preserving mode, ownership, xattrs, hardlinks and
+// timestamps exactly like Get does for an extracted archive.
+func Put(src string, dest string, options PutOptions) error {
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if !srcInfo.IsDir() {
+		if err := copyOneFile(src, dest, srcInfo, options); err != nil {
+			return err
+		}
+		return applyOwnerModeOverride(dest, srcInfo.IsDir(), options)
+	}
+
+	seenInodes := map[string]string{}
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		if rel != "." && Matches(options.IgnorePatterns, filepath.ToSlash(rel)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		target := filepath.Join(dest, rel)
+
+		if info.IsDir() {
+			if err := os.MkdirAll(target, info.Mode()); err != nil {
+				return err
+			}
+			uid, gid := fileOwner(info)
+			uid, gid = remapOwner(uid, gid, options.UIDMap, options.GIDMap)
+			if err := lchown(target, uid, gid); err != nil {
+				return err
+			}
+			if err := copyXattrs(path, target); err != nil {
+				return err
+			}
+			if err := lutimes(target, time.Time{}, info.ModTime()); err != nil {
+				return err
+			}
+		} else if err := copyOneFileWithHardlinks(path, target, info, options, seenInodes); err != nil {
+			return err
+		}
+
+		return applyOwnerModeOverride(target, info.IsDir(), options)
+	})
+}
+
+// applyOwnerModeOverride applies options.Chown/Chmod - copy_from's chown:
+// and chmod: directives - to target, if set. It's called on every path Put
+// itself just wrote, so unlike a post-hoc tree walk over dest it can never
+// touch content that was already there before this Put call.
+//
+// Chmod is skipped for directories: copy_from's chmod: is meant for the
+// files being copied, and applying the same literal mode to a directory
+// (e.g. the common "644") would strip its execute bit and make its
+// contents untraversable. It's skipped for symlinks too, since os.Chmod
+// would follow the link and change whatever it points at instead.
+func applyOwnerModeOverride(target string, isDir bool, options PutOptions) error {
+	if options.Chown != nil {
+		if err := os.Lchown(target, options.Chown.UID, options.Chown.GID); err != nil {
+			return err
+		}
+	}
+
+	if options.Chmod != nil && !isDir {
+		fi, err := os.Lstat(target)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			if err := os.Chmod(target, *options.Chmod); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func copyOneFile(src, dest string, info os.FileInfo, options PutOptions) error {
+	return copyOneFileWithHardlinks(src, dest, info, options, map[string]string{})
+}
+
+func copyOneFileWithHardlinks(src, dest string, info os.FileInfo, options PutOptions, seenInodes map[string]string) error {
+	if link, ok := hardlinkSource(info, seenInodes); ok {
+		return os.Link(link, dest)
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		linkname, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(linkname, dest); err != nil {
+			return err
+		}
+	case info.Mode().IsRegular():
+		if err := copyRegularFile(src, dest, info); err != nil {
+			return err
+		}
+	default:
+		if err := mknodFromInfo(dest, info); err != nil {
+			return err
+		}
+	}
+
+	uid, gid := fileOwner(info)
+	uid, gid = remapOwner(uid, gid, options.UIDMap, options.GIDMap)
+	if err := lchown(dest, uid, gid); err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		if err := copyXattrs(src, dest); err != nil {
+			return err
+		}
+
+		if err := lutimes(dest, time.Time{}, info.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	rememberHardlink(info, dest, seenInodes)
+
+	return nil
+}
+
+func copyRegularFile(src, dest string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// peekReader is a tiny io.Reader wrapper that supports a 2-byte Peek,
+// enough to sniff the gzip magic without pulling in bufio's defaults.
+type peekReader struct {
+	r    io.Reader
+	peek []byte
+}
+
+func newPeekReader(r io.Reader) *peekReader {
+	return &peekReader{r: r}
+}
+
+func (p *peekReader) Peek(n int) ([]byte, error) {
+	if len(p.peek) >= n {
+		return p.peek[:n], nil
+	}
+
+	buf := make([]byte, n-len(p.peek))
+	read, err := io.ReadFull(p.r, buf)
+	p.peek = append(p.peek, buf[:read]...)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return p.peek, err
+	}
+
+	return p.peek, nil
+}
+
+func (p *peekReader) Read(buf []byte) (int, error) {
+	if len(p.peek) > 0 {
+		n := copy(buf, p.peek)
+		p.peek = p.peek[n:]
+		return n, nil
+	}
+
+	return p.r.Read(buf)
+}
@@ -0,0 +1,196 @@
+package copier
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPutCopiesFilesAndSymlinks(t *testing.T) {
+	src := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "file.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink("file.txt", filepath.Join(src, "sub", "link.txt")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	if err := Put(src, dest, PutOptions{}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "sub", "file.txt"))
+	if err != nil {
+		t.Fatalf("reading copied file: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("copied file contents = %q, want %q", got, "hello")
+	}
+
+	link, err := os.Readlink(filepath.Join(dest, "sub", "link.txt"))
+	if err != nil {
+		t.Fatalf("reading copied symlink: %v", err)
+	}
+	if link != "file.txt" {
+		t.Errorf("copied symlink target = %q, want %q", link, "file.txt")
+	}
+}
+
+func TestPutChownChmodOnlyTouchesWhatWasCopied(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	dest := t.TempDir()
+
+	// pre-existing content at dest that Put didn't write; it must come
+	// out of this call untouched.
+	preexistingDir := filepath.Join(dest, "preexisting")
+	if err := os.MkdirAll(preexistingDir, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	preexistingInfo, err := os.Stat(preexistingDir)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+
+	mode := os.FileMode(0600)
+	options := PutOptions{
+		Chown: &Owner{UID: os.Getuid(), GID: os.Getgid()},
+		Chmod: &mode,
+	}
+
+	if err := Put(src, filepath.Join(dest, "copied"), options); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	copiedDir := filepath.Join(dest, "copied")
+	dirInfo, err := os.Stat(copiedDir)
+	if err != nil {
+		t.Fatalf("stat copied dir: %v", err)
+	}
+	if dirInfo.Mode().Perm()&0100 == 0 {
+		t.Errorf("copied directory lost its execute bit: mode = %v", dirInfo.Mode())
+	}
+
+	fileInfo, err := os.Stat(filepath.Join(copiedDir, "file.txt"))
+	if err != nil {
+		t.Fatalf("stat copied file: %v", err)
+	}
+	if fileInfo.Mode().Perm() != mode {
+		t.Errorf("copied file mode = %v, want %v", fileInfo.Mode().Perm(), mode)
+	}
+
+	after, err := os.Stat(preexistingDir)
+	if err != nil {
+		t.Fatalf("stat preexisting dir: %v", err)
+	}
+	if after.Mode() != preexistingInfo.Mode() {
+		t.Errorf("pre-existing directory's mode changed: %v -> %v", preexistingInfo.Mode(), after.Mode())
+	}
+}
+
+func TestGetResolvesHardlinkTargetFromArchiveRoot(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	writeEntry := func(hdr *tar.Header, contents string) {
+		t.Helper()
+		if contents != "" {
+			hdr.Size = int64(len(contents))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader: %v", err)
+		}
+		if contents != "" {
+			if _, err := tw.Write([]byte(contents)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+	}
+
+	writeEntry(&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}, "")
+	writeEntry(&tar.Header{Name: "a/file1", Typeflag: tar.TypeReg, Mode: 0644}, "content")
+	writeEntry(&tar.Header{Name: "b/", Typeflag: tar.TypeDir, Mode: 0755}, "")
+	writeEntry(&tar.Header{Name: "b/file2", Typeflag: tar.TypeLink, Linkname: "a/file1"}, "")
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar Close: %v", err)
+	}
+
+	dest := t.TempDir()
+	if err := Get(&buf, dest, GetOptions{}); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "b", "file2"))
+	if err != nil {
+		t.Fatalf("reading hardlinked file: %v", err)
+	}
+	if string(got) != "content" {
+		t.Errorf("hardlinked file contents = %q, want %q", got, "content")
+	}
+}
+
+func TestWriteRegularFilePunchesSparseHoles(t *testing.T) {
+	size := int64(sparseBlockSize * 4)
+	hdr := &tar.Header{Size: size, Mode: 0644}
+
+	// all zero except the very last block
+	data := make([]byte, size)
+	copy(data[size-4:], []byte("tail"))
+
+	target := filepath.Join(t.TempDir(), "sparse")
+	if err := writeRegularFile(bytes.NewReader(data), target, hdr); err != nil {
+		t.Fatalf("writeRegularFile: %v", err)
+	}
+
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("reading sparse file: %v", err)
+	}
+	if int64(len(got)) != size {
+		t.Fatalf("sparse file size = %d, want %d", len(got), size)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("sparse file contents don't match source")
+	}
+}
+
+func TestCopyOneFilePreservesMtime(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	past := mtimeForTest()
+	if err := os.Chtimes(src, past, past); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	if err := Put(src, dest, PutOptions{}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	destInfo, err := os.Stat(dest)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if !destInfo.ModTime().Equal(past) {
+		t.Errorf("copied file mtime = %v, want %v", destInfo.ModTime(), past)
+	}
+}
+
+func mtimeForTest() time.Time {
+	return time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,110 @@
+package copier
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Pattern is a single parsed line from a .stackerignore file: a
+// dockerignore-style glob, optionally negated with a leading "!".
+type Pattern struct {
+	Negate bool
+	Glob   string
+}
+
+// ParseIgnoreFile reads a dockerignore-style .stackerignore file (blank
+// lines and "#" comments ignored, "!" negates a pattern, "**" matches any
+// number of path segments) and returns its patterns in file order. A
+// missing file is not an error; it just means there's nothing to ignore.
+func ParseIgnoreFile(path string) ([]Pattern, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []Pattern
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := Pattern{Glob: line}
+		if strings.HasPrefix(line, "!") {
+			p.Negate = true
+			p.Glob = strings.TrimPrefix(line, "!")
+		}
+
+		patterns = append(patterns, p)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "reading %s", path)
+	}
+
+	return patterns, nil
+}
+
+// Matches reports whether rel (a '/'-separated path relative to the copy
+// root) is ignored by patterns. Later patterns override earlier ones, so a
+// negated pattern after a broader match un-ignores it again, same as
+// dockerignore.
+func Matches(patterns []Pattern, rel string) bool {
+	ignored := false
+
+	for _, p := range patterns {
+		if matchGlob(p.Glob, rel) {
+			ignored = !p.Negate
+		}
+	}
+
+	return ignored
+}
+
+// matchGlob implements the subset of dockerignore glob syntax stacker
+// needs: filepath.Match per path segment, plus "**" meaning "zero or more
+// path segments".
+func matchGlob(glob, rel string) bool {
+	globParts := strings.Split(glob, "/")
+	relParts := strings.Split(rel, "/")
+
+	return matchParts(globParts, relParts)
+}
+
+func matchParts(globParts, relParts []string) bool {
+	if len(globParts) == 0 {
+		return len(relParts) == 0
+	}
+
+	head := globParts[0]
+
+	if head == "**" {
+		if matchParts(globParts[1:], relParts) {
+			return true
+		}
+		if len(relParts) == 0 {
+			return false
+		}
+		return matchParts(globParts, relParts[1:])
+	}
+
+	if len(relParts) == 0 {
+		return false
+	}
+
+	matched, err := filepath.Match(head, relParts[0])
+	if err != nil || !matched {
+		return false
+	}
+
+	return matchParts(globParts[1:], relParts[1:])
+}
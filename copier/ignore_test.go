@@ -0,0 +1,120 @@
+package copier
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatches(t *testing.T) {
+	cases := []struct {
+		name     string
+		patterns []Pattern
+		rel      string
+		want     bool
+	}{
+		{
+			name:     "no patterns",
+			patterns: nil,
+			rel:      "foo",
+			want:     false,
+		},
+		{
+			name:     "simple match",
+			patterns: []Pattern{{Glob: "foo"}},
+			rel:      "foo",
+			want:     true,
+		},
+		{
+			name:     "simple non-match",
+			patterns: []Pattern{{Glob: "foo"}},
+			rel:      "bar",
+			want:     false,
+		},
+		{
+			name:     "double star matches any depth",
+			patterns: []Pattern{{Glob: "**/*.log"}},
+			rel:      "a/b/c/debug.log",
+			want:     true,
+		},
+		{
+			name:     "double star matches zero segments",
+			patterns: []Pattern{{Glob: "**/*.log"}},
+			rel:      "debug.log",
+			want:     true,
+		},
+		{
+			name: "later negation un-ignores",
+			patterns: []Pattern{
+				{Glob: "*.log"},
+				{Glob: "keep.log", Negate: true},
+			},
+			rel:  "keep.log",
+			want: false,
+		},
+		{
+			name: "negation only applies to what it matches",
+			patterns: []Pattern{
+				{Glob: "*.log"},
+				{Glob: "keep.log", Negate: true},
+			},
+			rel:  "debug.log",
+			want: true,
+		},
+		{
+			name:     "single segment glob does not cross directories",
+			patterns: []Pattern{{Glob: "*.log"}},
+			rel:      "a/debug.log",
+			want:     false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := Matches(c.patterns, c.rel); got != c.want {
+				t.Errorf("Matches(%v, %q) = %v, want %v", c.patterns, c.rel, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseIgnoreFile(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("missing file is not an error", func(t *testing.T) {
+		patterns, err := ParseIgnoreFile(filepath.Join(dir, ".does-not-exist"))
+		if err != nil {
+			t.Fatalf("ParseIgnoreFile: %v", err)
+		}
+		if patterns != nil {
+			t.Errorf("ParseIgnoreFile on missing file = %v, want nil", patterns)
+		}
+	})
+
+	t.Run("parses comments, blanks, and negation", func(t *testing.T) {
+		path := filepath.Join(dir, ".stackerignore")
+		contents := "# a comment\n\n*.log\n!keep.log\n"
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("writing test fixture: %v", err)
+		}
+
+		patterns, err := ParseIgnoreFile(path)
+		if err != nil {
+			t.Fatalf("ParseIgnoreFile: %v", err)
+		}
+
+		want := []Pattern{
+			{Glob: "*.log"},
+			{Glob: "keep.log", Negate: true},
+		}
+
+		if len(patterns) != len(want) {
+			t.Fatalf("ParseIgnoreFile = %v, want %v", patterns, want)
+		}
+		for i := range want {
+			if patterns[i] != want[i] {
+				t.Errorf("pattern %d = %v, want %v", i, patterns[i], want[i])
+			}
+		}
+	})
+}
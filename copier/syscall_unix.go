@@ -0,0 +1,106 @@
+// +build linux
+
+package copier
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func lchown(path string, uid, gid int) error {
+	return os.Lchown(path, uid, gid)
+}
+
+func lutimes(path string, atime, mtime time.Time) error {
+	if mtime.IsZero() {
+		return nil
+	}
+	if atime.IsZero() {
+		atime = mtime
+	}
+
+	return unix.Lutimes(path, []unix.Timeval{
+		unix.NsecToTimeval(atime.UnixNano()),
+		unix.NsecToTimeval(mtime.UnixNano()),
+	})
+}
+
+// mknod recreates a tar header entry that isn't a regular file, directory,
+// or link (character/block devices and fifos).
+func mknod(target string, hdr *tar.Header) error {
+	var mode uint32
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode = unix.S_IFCHR
+	case tar.TypeBlock:
+		mode = unix.S_IFBLK
+	case tar.TypeFifo:
+		mode = unix.S_IFIFO
+	default:
+		return fmt.Errorf("unsupported tar entry type %q for %s", hdr.Typeflag, target)
+	}
+
+	dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+	return unix.Mknod(target, mode|uint32(hdr.Mode), int(dev))
+}
+
+// mknodFromInfo is mknod's counterpart for Put, which only has an
+// os.FileInfo (from Lstat) to go on rather than a tar header.
+func mknodFromInfo(target string, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("can't determine device numbers for %s", target)
+	}
+
+	// st.Mode carries the kernel's S_IFBLK/S_IFCHR/S_IFIFO type bits
+	// directly; info.Mode() is Go's os.FileMode encoding (ModeDevice,
+	// ModeCharDevice, ...), which uses different bit values and would
+	// make mknod(2) create the wrong kind of node.
+	return unix.Mknod(target, st.Mode, int(st.Rdev))
+}
+
+// fileOwner reads the uid/gid off an os.FileInfo obtained via Lstat.
+func fileOwner(info os.FileInfo) (int, int) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+
+	return int(st.Uid), int(st.Gid)
+}
+
+// hardlinkSource checks whether info's inode has already been copied once
+// in this Put pass (tracked in seenInodes, keyed by "dev:ino"), and if
+// so returns the path it was copied to so the caller can recreate this
+// entry as a hardlink instead of duplicating the data.
+func hardlinkSource(info os.FileInfo, seenInodes map[string]string) (string, bool) {
+	if info.IsDir() {
+		return "", false
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return "", false
+	}
+
+	key := fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+	path, ok := seenInodes[key]
+	return path, ok
+}
+
+func rememberHardlink(info os.FileInfo, dest string, seenInodes map[string]string) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return
+	}
+
+	key := fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+	if _, exists := seenInodes[key]; !exists {
+		seenInodes[key] = dest
+	}
+}
@@ -0,0 +1,91 @@
+// +build linux
+
+package copier
+
+import (
+	"archive/tar"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyXattrs copies every extended attribute set on src onto dest,
+// including the security.capability and user.* namespaces that matter most
+// for container rootfs round-tripping.
+func copyXattrs(src, dest string) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		value, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			continue
+		}
+
+		buf := make([]byte, value)
+		if value > 0 {
+			if _, err := unix.Lgetxattr(src, name, buf); err != nil {
+				continue
+			}
+		}
+
+		if err := unix.Lsetxattr(dest, name, buf, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyXattrsFromTarHeader restores the xattrs archive/tar recorded on hdr
+// (under its PAX "SCHILY.xattr." records) onto the freshly extracted target.
+func copyXattrsFromTarHeader(hdr *tar.Header, target string) error {
+	for key, value := range hdr.PAXRecords {
+		const prefix = "SCHILY.xattr."
+		if len(key) <= len(prefix) || key[:len(prefix)] != prefix {
+			continue
+		}
+
+		name := key[len(prefix):]
+		if err := unix.Lsetxattr(target, name, []byte(value), 0); err != nil {
+			if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func listXattrs(path string) ([]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	n, err := unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	start := 0
+	for i := 0; i < n; i++ {
+		if buf[i] == 0 {
+			names = append(names, string(buf[start:i]))
+			start = i + 1
+		}
+	}
+
+	return names, nil
+}
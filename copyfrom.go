@@ -0,0 +1,96 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/anuvu/stacker/copier"
+	"github.com/pkg/errors"
+)
+
+// CopyFromEntry is one entry of a layer's `copy_from:` list: copy src out of
+// stage's already-built rootfs into dest in this layer, optionally
+// re-owning/re-moding it on the way in. It's stacker's equivalent of
+// docker/buildah's `COPY --from=<stage>`.
+type CopyFromEntry struct {
+	Stage string `yaml:"stage"`
+	Src   string `yaml:"src"`
+	Dest  string `yaml:"dest"`
+	Chown string `yaml:"chown"`
+	Chmod string `yaml:"chmod"`
+}
+
+// doCopyFrom applies every copy_from entry in entries, copying from each named
+// stage's built rootfs (which must already exist - the caller is
+// responsible for making sure stageDeps() ordered this layer after its
+// copy_from stages) into workRootfs, the in-progress layer's rootfs.
+func doCopyFrom(env *buildEnv, arch string, entries []CopyFromEntry, workRootfs string) error {
+	for _, e := range entries {
+		if err := copyFromOne(env, arch, e, workRootfs); err != nil {
+			return errors.Wrapf(err, "copy_from %s:%s", e.Stage, e.Src)
+		}
+	}
+
+	return nil
+}
+
+func copyFromOne(env *buildEnv, arch string, e CopyFromEntry, workRootfs string) error {
+	srcTag := archTag(e.Stage, arch)
+	srcRootfs := path.Join(env.opts.Config.RootFSDir, srcTag, "rootfs", e.Src)
+	dest := path.Join(workRootfs, e.Dest)
+
+	var options copier.PutOptions
+
+	if e.Chown != "" {
+		owner, err := parseChown(e.Chown)
+		if err != nil {
+			return err
+		}
+		options.Chown = owner
+	}
+
+	if e.Chmod != "" {
+		mode, err := parseChmod(e.Chmod)
+		if err != nil {
+			return err
+		}
+		options.Chmod = mode
+	}
+
+	// options.Chown/Chmod, if set, are applied by Put itself to exactly
+	// the paths it writes, so pre-existing content already at dest (from
+	// an earlier apply/run step, or another copy_from into the same
+	// parent) is never touched.
+	return copier.Put(srcRootfs, dest, options)
+}
+
+func parseChown(chown string) (*copier.Owner, error) {
+	parts := strings.SplitN(chown, ":", 2)
+
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad chown uid %q", chown)
+	}
+
+	gid := uid
+	if len(parts) == 2 {
+		gid, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad chown gid %q", chown)
+		}
+	}
+
+	return &copier.Owner{UID: uid, GID: gid}, nil
+}
+
+func parseChmod(chmod string) (*os.FileMode, error) {
+	mode, err := strconv.ParseUint(chmod, 8, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad chmod mode %q", chmod)
+	}
+
+	fileMode := os.FileMode(mode)
+	return &fileMode, nil
+}
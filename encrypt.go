@@ -0,0 +1,255 @@
+package stacker
+
+import (
+	"context"
+	"io"
+	"path"
+	"sync"
+
+	"github.com/containers/ocicrypt"
+	encconfig "github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/helpers"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MediaTypeLayerTarGzipEncrypted is the media type used for a tar+gzip
+	// layer that's been wrapped with ocicrypt.
+	MediaTypeLayerTarGzipEncrypted = "application/vnd.oci.image.layer.v1.tar+gzip+encrypted"
+
+	// MediaTypeLayerSquashfsEncrypted is the encrypted counterpart of
+	// MediaTypeLayerSquashfs.
+	MediaTypeLayerSquashfsEncrypted = MediaTypeLayerSquashfs + "+encrypted"
+)
+
+// isEncryptedLayer matches the exported and decorated media types so callers
+// can tell an already-encrypted layer apart from a plaintext one.
+func isEncryptedLayer(mediaType string) bool {
+	return mediaType == MediaTypeLayerTarGzipEncrypted || mediaType == MediaTypeLayerSquashfsEncrypted
+}
+
+// encryptCryptoConfig builds an ocicrypt EncryptConfig from a list of
+// recipients, each a `provider:path-or-spec` string as accepted by
+// containers/ocicrypt (e.g. a PGP, JWE, or PKCS7 public key path).
+func encryptCryptoConfig(recipients []string) (encconfig.CryptoConfig, error) {
+	return helpers.CreateCryptoConfig(recipients, []string{})
+}
+
+// decryptCryptoConfig builds an ocicrypt DecryptConfig from a list of
+// private key specs.
+func decryptCryptoConfig(keys []string) (encconfig.CryptoConfig, error) {
+	return helpers.CreateCryptoConfig([]string{}, keys)
+}
+
+// encryptLayer reads the plaintext layer blob for desc out of oci, wraps it
+// with ocicrypt for recipients, writes the resulting ciphertext as a new
+// blob, and returns its descriptor (with the `+encrypted` media type and
+// ocicrypt's key-wrapping annotations set).
+func encryptLayer(oci casext.Engine, desc ispec.Descriptor, recipients []string) (ispec.Descriptor, error) {
+	if len(recipients) == 0 {
+		return desc, nil
+	}
+
+	var encMediaType string
+	switch desc.MediaType {
+	case ispec.MediaTypeImageLayerGzip:
+		encMediaType = MediaTypeLayerTarGzipEncrypted
+	case MediaTypeLayerSquashfs:
+		encMediaType = MediaTypeLayerSquashfsEncrypted
+	default:
+		return desc, errors.Errorf("don't know how to encrypt layer of media type %s", desc.MediaType)
+	}
+
+	cc, err := encryptCryptoConfig(recipients)
+	if err != nil {
+		return desc, errors.Wrapf(err, "couldn't load encryption recipients")
+	}
+
+	plaintext, err := oci.GetBlob(context.Background(), desc.Digest)
+	if err != nil {
+		return desc, errors.Wrapf(err, "couldn't read layer %s", desc.Digest)
+	}
+	defer plaintext.Close()
+
+	encReader, encAnnotations, err := ocicrypt.EncryptLayer(cc.EncryptConfig, plaintext, desc)
+	if err != nil {
+		return desc, errors.Wrapf(err, "couldn't encrypt layer %s", desc.Digest)
+	}
+
+	encDigest, encSize, err := oci.PutBlob(context.Background(), io.Reader(encReader))
+	if err != nil {
+		return desc, errors.Wrapf(err, "couldn't store encrypted layer")
+	}
+
+	encDesc := ispec.Descriptor{
+		MediaType:   encMediaType,
+		Digest:      encDigest,
+		Size:        encSize,
+		Annotations: map[string]string{},
+	}
+
+	for k, v := range desc.Annotations {
+		encDesc.Annotations[k] = v
+	}
+	for k, v := range encAnnotations {
+		encDesc.Annotations[k] = v
+	}
+
+	return encDesc, nil
+}
+
+// shouldEncryptLayer reports whether name matches one of the configured
+// EncryptLayers glob patterns.
+func shouldEncryptLayer(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return false, errors.Wrapf(err, "bad encrypt layer pattern %q", pattern)
+		}
+
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// encryptManifestLayers re-encrypts every layer in tag's manifest for
+// recipients and updates the manifest (and the tag's reference) in place to
+// point at the encrypted blobs.
+//
+// ociMu only needs to guard the manifest lookup and the final
+// PutBlobJSON/UpdateReference below; the blob read/encrypt/write loop in
+// encryptLayer is the expensive part of this step and runs unlocked so it
+// doesn't serialize other stages building concurrently.
+func encryptManifestLayers(oci casext.Engine, ociMu *sync.Mutex, tag string, recipients []string) error {
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	ociMu.Lock()
+	manifest, err := LookupManifest(oci, tag)
+	ociMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for i, layer := range manifest.Layers {
+		encDesc, err := encryptLayer(oci, layer, recipients)
+		if err != nil {
+			return err
+		}
+
+		manifest.Layers[i] = encDesc
+	}
+
+	ociMu.Lock()
+	defer ociMu.Unlock()
+
+	manifestDigest, manifestSize, err := oci.PutBlobJSON(context.Background(), manifest)
+	if err != nil {
+		return err
+	}
+
+	return oci.UpdateReference(context.Background(), tag, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	})
+}
+
+// decryptCachedLayers opens the layer-bases OCI cache and decrypts, in
+// place, any ocicrypt-encrypted layers in tag's manifest, so that the
+// unpack that follows (umoci unpack, in extractOutput) never has to deal
+// with ciphertext. It's a no-op if the manifest has no encrypted layers.
+func decryptCachedLayers(cacheDir string, tag string, keys []string) error {
+	oci, err := umoci.OpenLayout(cacheDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	manifest, err := LookupManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for i, layer := range manifest.Layers {
+		if !isEncryptedLayer(layer.MediaType) {
+			continue
+		}
+
+		decDesc, err := decryptLayer(oci, layer, keys)
+		if err != nil {
+			return err
+		}
+
+		manifest.Layers[i] = decDesc
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	manifestDigest, manifestSize, err := oci.PutBlobJSON(context.Background(), manifest)
+	if err != nil {
+		return err
+	}
+
+	return oci.UpdateReference(context.Background(), tag, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	})
+}
+
+// decryptLayer is called on the import side, by decryptCachedLayers after
+// runSkopeo's lib.ImageCopy, when a base image has encrypted layers; keys are
+// private-key specs accepted by containers/ocicrypt needed to unwrap them.
+func decryptLayer(oci casext.Engine, desc ispec.Descriptor, keys []string) (ispec.Descriptor, error) {
+	if !isEncryptedLayer(desc.MediaType) {
+		return desc, nil
+	}
+
+	if len(keys) == 0 {
+		return desc, errors.Errorf("layer %s is encrypted but no decrypt keys were configured", desc.Digest)
+	}
+
+	dc, err := decryptCryptoConfig(keys)
+	if err != nil {
+		return desc, errors.Wrapf(err, "couldn't load decryption keys")
+	}
+
+	ciphertext, err := oci.GetBlob(context.Background(), desc.Digest)
+	if err != nil {
+		return desc, errors.Wrapf(err, "couldn't read encrypted layer %s", desc.Digest)
+	}
+	defer ciphertext.Close()
+
+	decReader, _, err := ocicrypt.DecryptLayer(dc.DecryptConfig, ciphertext, desc, false)
+	if err != nil {
+		return desc, errors.Wrapf(err, "couldn't decrypt layer %s", desc.Digest)
+	}
+
+	decDigest, decSize, err := oci.PutBlob(context.Background(), decReader)
+	if err != nil {
+		return desc, errors.Wrapf(err, "couldn't store decrypted layer")
+	}
+
+	decMediaType := ispec.MediaTypeImageLayerGzip
+	if desc.MediaType == MediaTypeLayerSquashfsEncrypted {
+		decMediaType = MediaTypeLayerSquashfs
+	}
+
+	return ispec.Descriptor{
+		MediaType: decMediaType,
+		Digest:    decDigest,
+		Size:      decSize,
+	}, nil
+}
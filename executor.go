@@ -0,0 +1,151 @@
+package stacker
+
+import (
+	"runtime"
+	"sync"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// stageExecutor builds the layers of a single architecture's stackerfile,
+// running stages whose dependencies are already satisfied concurrently, up
+// to a configurable job limit. It's modeled on buildah's split between a
+// top-level executor and a per-stage builder: each stage still builds
+// serially internally (buildOneLayer), but independent stages overlap.
+type stageExecutor struct {
+	env   *buildEnv
+	order []string
+	arch  string
+	jobs  int
+
+	// done[name] is closed once name has finished building (successfully
+	// or not); waiting on it is how a dependent stage blocks until its
+	// dependency is ready.
+	done map[string]chan struct{}
+
+	mu        sync.Mutex
+	descs     map[string]ispec.Descriptor
+	buildOnly map[string]bool
+	err       error
+}
+
+func newStageExecutor(env *buildEnv, order []string, arch string) *stageExecutor {
+	jobs := env.opts.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	done := make(map[string]chan struct{}, len(order))
+	for _, name := range order {
+		done[name] = make(chan struct{})
+	}
+
+	return &stageExecutor{
+		env:       env,
+		order:     order,
+		arch:      arch,
+		jobs:      jobs,
+		done:      done,
+		descs:     map[string]ispec.Descriptor{},
+		buildOnly: map[string]bool{},
+	}
+}
+
+// run builds every stage in e.order, running stages whose dependencies are
+// already done concurrently up to e.jobs at a time, and returns the
+// descriptor of every non-build-only stage once the whole DAG has drained.
+func (e *stageExecutor) run() (map[string]ispec.Descriptor, error) {
+	sem := make(chan struct{}, e.jobs)
+	var wg sync.WaitGroup
+
+	for _, name := range e.order {
+		name := name
+		deps := e.stageDeps(name)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(e.done[name])
+
+			// wait for every dependency to finish before taking a
+			// worker slot, so we don't hold a slot idle while
+			// blocked on a stage that isn't ready yet.
+			for _, dep := range deps {
+				if ch, ok := e.done[dep]; ok {
+					<-ch
+				}
+			}
+
+			if e.failed() {
+				return
+			}
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			desc, buildOnly, err := buildOneLayer(e.env, e.arch, name)
+			if err != nil {
+				e.fail(err)
+				return
+			}
+
+			e.mu.Lock()
+			e.descs[name] = desc
+			e.buildOnly[name] = buildOnly
+			e.mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	final := map[string]ispec.Descriptor{}
+	for name, buildOnly := range e.buildOnly {
+		if !buildOnly {
+			final[name] = e.descs[name]
+		}
+	}
+
+	return final, nil
+}
+
+func (e *stageExecutor) fail(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *stageExecutor) failed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err != nil
+}
+
+// stageDeps returns the names of stages that must finish building before
+// name can start: its FROM stage when it's built on top of another stage in
+// this stackerfile, plus any stage a copy_from entry pulls files from. The
+// latter also means that stage's rootfs snapshot must be retained
+// (buildOneLayer never deletes a stage's final snapshot, only its
+// .working-<stage> scratch space) until every dependent has run.
+func (e *stageExecutor) stageDeps(name string) []string {
+	l, ok := e.env.sf.Get(name)
+	if !ok {
+		return nil
+	}
+
+	var deps []string
+	if l.From.Type == BuiltType {
+		deps = append(deps, l.From.Tag)
+	}
+
+	for _, cf := range l.CopyFrom {
+		deps = append(deps, cf.Stage)
+	}
+
+	return deps
+}
@@ -4,25 +4,21 @@ import (
 	"fmt"
 	"os"
 	"path"
+
+	"github.com/anuvu/stacker/copier"
 )
 
+// Grab copies source (a path inside name's ".working-<name>" layer rootfs)
+// out to the current working directory on the host.
 func Grab(sc StackerConfig, name string, source string) error {
-	c, err := newContainer(sc, ".working")
-	if err != nil {
-		return err
-	}
-	defer c.Close()
-
 	cwd, err := os.Getwd()
 	if err != nil {
 		return err
 	}
 
-	err = c.bindMount(cwd, "/stacker", "")
-	if err != nil {
-		return err
-	}
-	defer os.Remove(path.Join(sc.RootFSDir, ".working", "rootfs", "stacker"))
+	work := fmt.Sprintf(".working-%s", name)
+	rootfsPath := path.Join(sc.RootFSDir, work, "rootfs", source)
+	dest := path.Join(cwd, path.Base(source))
 
-	return c.execute(fmt.Sprintf("cp -a %s /stacker", source), nil)
+	return copier.Put(rootfsPath, dest, copier.PutOptions{})
 }
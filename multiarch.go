@@ -0,0 +1,57 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// qemuInterpreter maps a GOARCH name to the qemu-user-static interpreter
+// binary that can execute binaries built for it, mirroring the table
+// buildah uses for cross-arch `buildah bud`.
+var qemuInterpreter = map[string]string{
+	"arm64":   "qemu-aarch64-static",
+	"arm":     "qemu-arm-static",
+	"386":     "qemu-i386-static",
+	"ppc64le": "qemu-ppc64le-static",
+	"s390x":   "qemu-s390x-static",
+	"riscv64": "qemu-riscv64-static",
+	"amd64":   "qemu-x86_64-static",
+}
+
+// maybeSetupBinfmt makes sure the host can execute binaries for arch. If
+// arch is the host's own architecture, this is a no-op. Otherwise it checks
+// that binfmt_misc has already registered a handler for arch (via
+// qemu-user-static, typically registered by `update-binfmts` or
+// `multiarch/qemu-user-static` at host setup time) and errors out with an
+// actionable message if not, rather than silently producing a broken image.
+func maybeSetupBinfmt(arch string) error {
+	if arch == runtime.GOARCH {
+		return nil
+	}
+
+	interpreter, ok := qemuInterpreter[arch]
+	if !ok {
+		return errors.Errorf("don't know how to cross-build for arch %q", arch)
+	}
+
+	binfmtPath := fmt.Sprintf("/proc/sys/fs/binfmt_misc/%s", interpreter)
+	if _, err := os.Stat(binfmtPath); err == nil {
+		return nil
+	}
+
+	if _, err := exec.LookPath(interpreter); err != nil {
+		return errors.Errorf(
+			"cross-building for %s requires %s to be installed and registered "+
+				"with binfmt_misc (e.g. via the multiarch/qemu-user-static "+
+				"project); %s not found on PATH", arch, interpreter, interpreter)
+	}
+
+	return errors.Errorf(
+		"%s is installed but not registered with binfmt_misc for %s; "+
+			"run update-binfmts or the multiarch/qemu-user-static "+
+			"registration script before building", interpreter, arch)
+}
@@ -0,0 +1,319 @@
+package stacker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// NetworkMode selects how a container's network namespace is configured
+// before the run-time command executes.
+type NetworkMode string
+
+const (
+	// NetworkModeNone leaves the container without any network setup at
+	// all; not even loopback is guaranteed to be up.
+	NetworkModeNone NetworkMode = "none"
+
+	// NetworkModeHost runs the command in the host's network namespace.
+	NetworkModeHost NetworkMode = "host"
+
+	// NetworkModeCNI attaches the container to one or more named CNI
+	// networks before the command runs.
+	NetworkModeCNI NetworkMode = "cni"
+)
+
+// NetworkConfig describes how a layer's Run step should be networked. It is
+// parsed from a stackerfile's `network:` block.
+type NetworkConfig struct {
+	Mode NetworkMode `yaml:"mode"`
+
+	// Networks is the list of CNI network names to ADD the container to,
+	// in order. Only meaningful when Mode is NetworkModeCNI.
+	Networks []string `yaml:"networks"`
+}
+
+// cniResult mirrors the fields of the CNI v0.4.0+ current.Result type that
+// stacker actually needs; we don't link against the full cni/pkg/types/current
+// package to avoid pulling in its build tags.
+type cniResult struct {
+	CNIVersion string `json:"cniVersion"`
+	Interfaces []struct {
+		Name    string `json:"name"`
+		Mac     string `json:"mac,omitempty"`
+		Sandbox string `json:"sandbox,omitempty"`
+	} `json:"interfaces,omitempty"`
+	IPs []struct {
+		Version   string `json:"version"`
+		Address   string `json:"address"`
+		Gateway   string `json:"gateway,omitempty"`
+		Interface *int   `json:"interface,omitempty"`
+	} `json:"ips,omitempty"`
+}
+
+// attachedNetwork records enough state about a single CNI ADD so that it can
+// be torn down later with a matching DEL.
+type attachedNetwork struct {
+	name   string
+	confDir string
+	pluginDir string
+	containerID string
+	netns  string
+	ifname string
+	result cniResult
+}
+
+// SetupNetwork configures netns according to cfg before the container's
+// command runs, and reports whether it actually created a namespace there:
+//
+//   - NetworkModeHost (and an unset/empty mode, preserving the pre-network
+//     behavior for every stackerfile that predates the network: block) is a
+//     true no-op: the container runs in the build process's own namespace,
+//     and no netns is created.
+//   - NetworkModeNone gets its own empty, unconfigured namespace, so it's
+//     actually isolated from the host network rather than just aliasing
+//     NetworkModeHost.
+//   - NetworkModeCNI gets its own namespace too, with each of cfg.Networks
+//     ADDed to it in order.
+//
+// When created is true, the caller (buildOneLayer) should pass netns to Run
+// so the container joins the namespace instead of the build process's own,
+// and must eventually call TeardownNetwork to tear it back down. It also
+// returns the list of networks that were successfully ADDed, in ADD order,
+// for the caller to pass to TeardownNetwork. If an ADD fails, SetupNetwork
+// itself DELs the networks it already ADDed, in reverse order, removes
+// netns, and returns a nil list with created false.
+func SetupNetwork(sc StackerConfig, cfg NetworkConfig, containerID string, netns string) ([]attachedNetwork, bool, error) {
+	switch cfg.Mode {
+	case "", NetworkModeHost:
+		return nil, false, nil
+	case NetworkModeNone:
+		if err := createNetns(netns); err != nil {
+			return nil, false, errors.Wrapf(err, "couldn't create network namespace at %s", netns)
+		}
+		return nil, true, nil
+	case NetworkModeCNI:
+		// fall through
+	default:
+		return nil, false, errors.Errorf("unknown network mode %q", cfg.Mode)
+	}
+
+	if err := createNetns(netns); err != nil {
+		return nil, false, errors.Wrapf(err, "couldn't create network namespace at %s", netns)
+	}
+
+	attached := make([]attachedNetwork, 0, len(cfg.Networks))
+	for i, name := range cfg.Networks {
+		ifname := fmt.Sprintf("eth%d", i)
+
+		an := attachedNetwork{
+			name:        name,
+			confDir:     sc.CNIConfDir,
+			pluginDir:   sc.CNIPluginDir,
+			containerID: containerID,
+			netns:       netns,
+			ifname:      ifname,
+		}
+
+		result, err := cniAdd(an)
+		if err != nil {
+			// unwind everything we already ADDed, in reverse order
+			TeardownNetwork(attached, true, netns)
+			return nil, false, errors.Wrapf(err, "cni ADD failed for network %s", name)
+		}
+
+		an.result = *result
+		attached = append(attached, an)
+	}
+
+	return attached, true, nil
+}
+
+// TeardownNetwork calls CNI DEL for every attached network, in reverse of
+// the order they were ADDed, then - if created (SetupNetwork's second
+// return value) is true - unmounts and removes netns. It collects and
+// returns the first error encountered, but always attempts every step so a
+// failure in one doesn't leak the rest.
+func TeardownNetwork(attached []attachedNetwork, created bool, netns string) error {
+	var firstErr error
+	for i := len(attached) - 1; i >= 0; i-- {
+		if err := cniDel(attached[i]); err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "cni DEL failed for network %s", attached[i].name)
+			}
+		}
+	}
+
+	if !created {
+		return firstErr
+	}
+
+	if err := deleteNetns(netns); err != nil && firstErr == nil {
+		firstErr = errors.Wrapf(err, "couldn't delete network namespace %s", netns)
+	}
+
+	return firstErr
+}
+
+// createNetns makes a fresh Linux network namespace and bind-mounts it onto
+// nsPath, the same trick `ip netns add` and CNI's ns.NewNS use to give a
+// namespace a path that other processes (here, the Run container launcher
+// and the CNI plugins SetupNetwork execs) can join with setns(2) without
+// needing to share a process tree.
+func createNetns(nsPath string) error {
+	if err := os.MkdirAll(path.Dir(nsPath), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(nsPath, os.O_CREATE|os.O_EXCL, 0)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create netns file %s", nsPath)
+	}
+	f.Close()
+
+	// Unshare/Setns only affect the calling OS thread, so we need to pin
+	// this goroutine to its thread for the duration and explicitly
+	// restore the thread's original namespace before releasing it back to
+	// the scheduler. /proc/self resolves via the thread-group (process)
+	// ID, not this goroutine's locked OS thread, so it would point at the
+	// process's leading thread instead - use /proc/thread-self, which is
+	// always the calling thread, the same fix containernetworking/plugins'
+	// pkg/ns applies for exactly this reason.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origNS, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		os.Remove(nsPath)
+		return errors.Wrap(err, "couldn't save current netns")
+	}
+	defer origNS.Close()
+
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		os.Remove(nsPath)
+		return errors.Wrap(err, "couldn't unshare network namespace")
+	}
+
+	mountErr := unix.Mount("/proc/thread-self/ns/net", nsPath, "none", unix.MS_BIND, "")
+
+	if err := unix.Setns(int(origNS.Fd()), unix.CLONE_NEWNET); err != nil {
+		os.Remove(nsPath)
+		return errors.Wrap(err, "couldn't restore original netns")
+	}
+
+	if mountErr != nil {
+		os.Remove(nsPath)
+		return errors.Wrapf(mountErr, "couldn't bind mount netns onto %s", nsPath)
+	}
+
+	return nil
+}
+
+// deleteNetns undoes createNetns: it unmounts the namespace bind-mounted at
+// nsPath (dropping the kernel's last reference to it) and removes the file.
+func deleteNetns(nsPath string) error {
+	if err := unix.Unmount(nsPath, unix.MNT_DETACH); err != nil && err != unix.EINVAL && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "couldn't unmount netns %s", nsPath)
+	}
+
+	if err := os.Remove(nsPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "couldn't remove netns file %s", nsPath)
+	}
+
+	return nil
+}
+
+func cniAdd(an attachedNetwork) (*cniResult, error) {
+	return runCNIPlugin(an, "ADD")
+}
+
+func cniDel(an attachedNetwork) error {
+	_, err := runCNIPlugin(an, "DEL")
+	return err
+}
+
+// runCNIPlugin execs the plugin binary named by the top-level "type" field
+// of the network's config (read from <confDir>/<name>.conf, .conflist or
+// .json, tried in that order) with the standard CNI_* environment variables
+// and the conf JSON on stdin. The "plugins" chain of a .conflist is not run:
+// a config without a top-level "type" is an error.
+func runCNIPlugin(an attachedNetwork, command string) (*cniResult, error) {
+	confPath, conf, err := loadCNIConf(an.confDir, an.name)
+	if err != nil {
+		return nil, err
+	}
+
+	pluginType, ok := conf["type"].(string)
+	if !ok || pluginType == "" {
+		return nil, errors.Errorf("%s: missing \"type\" field", confPath)
+	}
+
+	plugin := path.Join(an.pluginDir, pluginType)
+	if _, err := os.Stat(plugin); err != nil {
+		return nil, errors.Wrapf(err, "cni plugin %s not found", plugin)
+	}
+
+	confJSON, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(plugin)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("CNI_COMMAND=%s", command),
+		fmt.Sprintf("CNI_CONTAINERID=%s", an.containerID),
+		fmt.Sprintf("CNI_NETNS=%s", an.netns),
+		fmt.Sprintf("CNI_IFNAME=%s", an.ifname),
+		fmt.Sprintf("CNI_PATH=%s", an.pluginDir),
+		fmt.Sprintf("CNI_ARGS=%s", ""),
+	)
+	cmd.Stdin = bytes.NewReader(confJSON)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Errorf("%s %s failed: %s: %s", plugin, command, err, stderr.String())
+	}
+
+	if command == "DEL" {
+		return nil, nil
+	}
+
+	result := &cniResult{}
+	if err := json.Unmarshal(stdout.Bytes(), result); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse cni result: %s", stdout.String())
+	}
+
+	return result, nil
+}
+
+func loadCNIConf(confDir string, name string) (string, map[string]interface{}, error) {
+	for _, ext := range []string{".conf", ".conflist", ".json"} {
+		confPath := path.Join(confDir, name+ext)
+		contents, err := os.ReadFile(confPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", nil, err
+		}
+
+		conf := map[string]interface{}{}
+		if err := json.Unmarshal(contents, &conf); err != nil {
+			return "", nil, errors.Wrapf(err, "invalid cni conf %s", confPath)
+		}
+
+		return confPath, conf, nil
+	}
+
+	return "", nil, errors.Errorf("no cni network config named %q found in %s", name, confDir)
+}
@@ -0,0 +1,68 @@
+package stacker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCNIConf(t *testing.T) {
+	dir := t.TempDir()
+
+	confPath := filepath.Join(dir, "mynet.conf")
+	contents := `{"cniVersion": "0.4.0", "name": "mynet", "type": "bridge"}`
+	if err := os.WriteFile(confPath, []byte(contents), 0644); err != nil {
+		t.Fatalf("writing test fixture: %v", err)
+	}
+
+	gotPath, conf, err := loadCNIConf(dir, "mynet")
+	if err != nil {
+		t.Fatalf("loadCNIConf: %v", err)
+	}
+	if gotPath != confPath {
+		t.Errorf("loadCNIConf path = %q, want %q", gotPath, confPath)
+	}
+	if conf["type"] != "bridge" {
+		t.Errorf("loadCNIConf type = %v, want %q", conf["type"], "bridge")
+	}
+}
+
+func TestLoadCNIConfFallsBackToConflist(t *testing.T) {
+	dir := t.TempDir()
+
+	// only a .conflist exists; loadCNIConf should still find it even
+	// though .conf is tried first.
+	confPath := filepath.Join(dir, "mynet.conflist")
+	contents := `{"cniVersion": "0.4.0", "name": "mynet", "plugins": [{"type": "bridge"}]}`
+	if err := os.WriteFile(confPath, []byte(contents), 0644); err != nil {
+		t.Fatalf("writing test fixture: %v", err)
+	}
+
+	gotPath, _, err := loadCNIConf(dir, "mynet")
+	if err != nil {
+		t.Fatalf("loadCNIConf: %v", err)
+	}
+	if gotPath != confPath {
+		t.Errorf("loadCNIConf path = %q, want %q", gotPath, confPath)
+	}
+}
+
+func TestLoadCNIConfMissing(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, _, err := loadCNIConf(dir, "nosuchnet"); err == nil {
+		t.Error("loadCNIConf on a missing network config: got nil error, want one")
+	}
+}
+
+func TestLoadCNIConfInvalidJSON(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "bad.conf"), []byte("not json"), 0644); err != nil {
+		t.Fatalf("writing test fixture: %v", err)
+	}
+
+	if _, _, err := loadCNIConf(dir, "bad"); err == nil {
+		t.Error("loadCNIConf on invalid json: got nil error, want one")
+	}
+}